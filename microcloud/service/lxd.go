@@ -1,101 +1,629 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"time"
 
 	"github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/lxd/util"
-	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
-	"gopkg.in/yaml.v2"
 )
 
 // LXDService is a LXD service.
 type LXDService struct {
 	client lxd.InstanceServer
+	ctx    context.Context
 	dir    string
 
-	name    string
-	address string
-	port    int
+	name           string
+	address        string
+	clusterAddress string
+	port           int
 }
 
 // NewLXDService creates a new LXD service with a client attached.
-func NewLXDService(name string, addr string, dir string) (*LXDService, error) {
+// The given context is used as the default for any operation that isn't
+// given an explicit context override. clusterAddr may be empty, in which
+// case raft/dqlite traffic shares addr instead of using a dedicated NIC.
+func NewLXDService(ctx context.Context, name string, addr string, clusterAddr string, dir string) (*LXDService, error) {
 	client, err := lxd.ConnectLXDUnix(filepath.Join(dir, "unix.socket"), nil)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to local LXD: %w", err)
 	}
 
 	return &LXDService{
-		client:  client,
-		dir:     dir,
-		name:    name,
-		address: addr,
-		port:    LXDPort,
+		client:         client,
+		ctx:            ctx,
+		dir:            dir,
+		name:           name,
+		address:        addr,
+		clusterAddress: clusterAddr,
+		port:           LXDPort,
 	}, nil
 }
 
-// Bootstrap bootstraps the LXD daemon on the default port.
-func (s LXDService) Bootstrap() error {
-	addr := util.CanonicalNetworkAddress(s.address, s.port)
+// useContext returns ctx if set, falling back to the service's default
+// context. This lets callers override the context for a single operation
+// while most call sites can simply pass nil.
+func (s LXDService) useContext(ctx context.Context) context.Context {
+	if ctx != nil {
+		return ctx
+	}
+
+	if s.ctx != nil {
+		return s.ctx
+	}
+
+	return context.Background()
+}
+
+// clientContext returns a client bound to ctx (falling back to the
+// service's default context when ctx is nil), so every request it issues
+// carries ctx as its "x-context" request option and can be cancelled or
+// time-bound by the caller.
+func (s LXDService) clientContext(ctx context.Context) lxd.InstanceServer {
+	return s.client.WithContext(s.useContext(ctx))
+}
+
+// clusterAddressOverride returns the cluster.https_address this member
+// should bind, or "" if none is configured and it should simply share its
+// core.https_address like a single-NIC setup.
+func (s LXDService) clusterAddressOverride() string {
+	if s.clusterAddress == "" {
+		return ""
+	}
 
-	server := api.ServerPut{Config: map[string]any{"core.https_address": addr, "cluster.https_address": addr}}
+	return util.CanonicalNetworkAddress(s.clusterAddress, s.port)
+}
+
+// configSubsetMatches reports whether every key in desired is present in
+// actual with the same value. Keys LXD fills in on read (e.g. a dir pool's
+// "source", or a bridge's auto-assigned "ipv4.address") that desired never
+// mentions are ignored, so a sparse desired config can match against the
+// fuller config a GetX call returns.
+func configSubsetMatches(desired, actual map[string]string) bool {
+	for k, v := range desired {
+		if actual[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeConfig returns a copy of actual with desired's keys overlaid, so
+// updating a resource with a sparse desired config doesn't clear config LXD
+// computed that the caller never mentioned.
+func mergeConfig(actual, desired map[string]string) map[string]string {
+	merged := make(map[string]string, len(actual)+len(desired))
+	for k, v := range actual {
+		merged[k] = v
+	}
+
+	for k, v := range desired {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// devicesSubsetMatch reports whether every device in desired is present in
+// actual with at least the same config keys and values.
+func devicesSubsetMatch(desired, actual map[string]map[string]string) bool {
+	for name, desiredDevice := range desired {
+		actualDevice, ok := actual[name]
+		if !ok || !configSubsetMatches(desiredDevice, actualDevice) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeDevices returns a copy of actual with desired's devices merged in
+// device-by-device, the same way mergeConfig merges a single device's keys.
+func mergeDevices(actual, desired map[string]map[string]string) map[string]map[string]string {
+	merged := make(map[string]map[string]string, len(actual)+len(desired))
+	for name, device := range actual {
+		merged[name] = device
+	}
+
+	for name, desiredDevice := range desired {
+		merged[name] = mergeConfig(merged[name], desiredDevice)
+	}
+
+	return merged
+}
+
+// BootstrapConfig describes the storage pools, networks and profiles to
+// apply when bootstrapping a new LXD cluster member, along with any extra
+// server config to merge in alongside the https addresses. This lets the
+// caller (typically the MicroCloud orchestrator, which has already
+// discovered MicroCeph/MicroOVN peers) compose a full preseed up front
+// rather than post-patching pools/networks after Bootstrap returns.
+type BootstrapConfig struct {
+	StoragePools []api.StoragePoolsPost
+	Networks     []api.NetworksPost
+	Profiles     []api.ProfilesPost
+	ServerConfig map[string]string
+
+	// Idempotent makes Bootstrap tolerate being re-run: it returns cleanly if
+	// this node is already the intended bootstrap node, and skips recreating
+	// any storage pool, network or profile that already exists rather than
+	// failing.
+	Idempotent bool
+}
+
+// DefaultBootstrapConfig returns the BootstrapConfig equivalent to the
+// single dir-backed "local" pool Bootstrap has always used.
+func DefaultBootstrapConfig() BootstrapConfig {
 	rootDisk := map[string]map[string]string{"root": {"path": "/", "pool": "local", "type": "disk"}}
-	profile := api.ProfilesPost{ProfilePut: api.ProfilePut{Devices: rootDisk}, Name: "default"}
-	storage := api.StoragePoolsPost{Name: "local", Driver: "dir"}
-
-	initData := api.InitPreseed{
-		Node: api.InitLocalPreseed{
-			ServerPut:    server,
-			StoragePools: []api.StoragePoolsPost{storage},
-			Profiles:     []api.ProfilesPost{profile},
+
+	return BootstrapConfig{
+		StoragePools: []api.StoragePoolsPost{{Name: "local", Driver: "dir"}},
+		Profiles:     []api.ProfilesPost{{ProfilePut: api.ProfilePut{Devices: rootDisk}, Name: "default"}},
+	}
+}
+
+// ZFSLoopBootstrapConfig returns a BootstrapConfig that backs the default
+// profile's root disk with a zfs pool on a loop device of the given size.
+func ZFSLoopBootstrapConfig(sizeGiB int) BootstrapConfig {
+	cfg := DefaultBootstrapConfig()
+	cfg.StoragePools = []api.StoragePoolsPost{
+		{
+			Name:           "local",
+			Driver:         "zfs",
+			StoragePoolPut: api.StoragePoolPut{Config: map[string]string{"size": fmt.Sprintf("%dGiB", sizeGiB)}},
 		},
 	}
 
-	data, err := yaml.Marshal(initData)
-	if err != nil {
-		return fmt.Errorf("Failed to parse preseed configuration as yaml: %w", err)
+	return cfg
+}
+
+// CephRBDBootstrapConfig returns a BootstrapConfig that backs the default
+// profile's root disk with a ceph-backed pool served by a remote MicroCeph
+// cluster.
+func CephRBDBootstrapConfig(cephClusterName string) BootstrapConfig {
+	cfg := DefaultBootstrapConfig()
+	cfg.StoragePools = []api.StoragePoolsPost{
+		{
+			Name:           "remote",
+			Driver:         "ceph",
+			StoragePoolPut: api.StoragePoolPut{Config: map[string]string{"ceph.cluster_name": cephClusterName}},
+		},
+	}
+
+	// DefaultBootstrapConfig's default profile points its root disk at
+	// "local", which this config doesn't create. Repoint it at "remote".
+	rootDisk := map[string]map[string]string{"root": {"path": "/", "pool": "remote", "type": "disk"}}
+	cfg.Profiles = []api.ProfilesPost{{ProfilePut: api.ProfilePut{Devices: rootDisk}, Name: "default"}}
+
+	return cfg
+}
+
+// OVNUplinkBootstrapConfig returns a BootstrapConfig that adds an OVN uplink
+// network bridged over parentNIC, for use alongside a MicroOVN cluster.
+func OVNUplinkBootstrapConfig(parentNIC string) BootstrapConfig {
+	cfg := DefaultBootstrapConfig()
+	cfg.Networks = []api.NetworksPost{
+		{
+			Name:       "UPLINK",
+			Type:       "physical",
+			NetworkPut: api.NetworkPut{Config: map[string]string{"parent": parentNIC}},
+		},
+	}
+
+	return cfg
+}
+
+// BootstrapErrorKind classifies why a BootstrapConfig resource failed to
+// apply, so callers can react without parsing error strings.
+type BootstrapErrorKind int
+
+const (
+	// BootstrapErrorOther covers failures that don't fit another kind.
+	BootstrapErrorOther BootstrapErrorKind = iota
+
+	// BootstrapErrorExists means the resource already existed.
+	BootstrapErrorExists
+
+	// BootstrapErrorPermission means LXD rejected the request as unauthorized.
+	BootstrapErrorPermission
+
+	// BootstrapErrorValidation means LXD rejected the resource's configuration.
+	BootstrapErrorValidation
+)
+
+// BootstrapError reports which BootstrapConfig resource Bootstrap failed to
+// apply and why.
+type BootstrapError struct {
+	Kind     BootstrapErrorKind
+	Resource string
+	Name     string
+	Err      error
+}
+
+func (e *BootstrapError) Error() string {
+	return fmt.Sprintf("Failed to apply %s %q: %v", e.Resource, e.Name, e.Err)
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
+
+func newBootstrapError(resource string, name string, err error) *BootstrapError {
+	kind := BootstrapErrorOther
+	switch {
+	case api.StatusErrorCheck(err, http.StatusConflict):
+		kind = BootstrapErrorExists
+	case api.StatusErrorCheck(err, http.StatusForbidden), api.StatusErrorCheck(err, http.StatusUnauthorized):
+		kind = BootstrapErrorPermission
+	case api.StatusErrorCheck(err, http.StatusBadRequest):
+		kind = BootstrapErrorValidation
 	}
 
-	stdin := bytes.Buffer{}
-	_, err = stdin.Write(data)
+	return &BootstrapError{Kind: kind, Resource: resource, Name: name, Err: err}
+}
+
+// Bootstrap bootstraps the LXD daemon on the default port, applying cfg's
+// storage pools, networks and profiles directly against the API in the same
+// order `lxd init` uses. If any step fails, everything created earlier in
+// the run is deleted again before returning.
+//
+// If cfg.Idempotent is set and this node is already the intended bootstrap
+// node, Bootstrap instead reconciles any drift on the existing pools,
+// networks and profiles and returns — see reconcileBootstrapConfig.
+func (s LXDService) Bootstrap(ctx context.Context, cfg BootstrapConfig) error {
+	ctx = s.useContext(ctx)
+	client := s.clientContext(ctx)
+
+	currentCluster, _, err := client.GetCluster()
 	if err != nil {
-		return fmt.Errorf("Failed to write preseed configuration: %w", err)
+		return fmt.Errorf("Failed to retrieve current cluster config: %w", err)
 	}
 
-	err = shared.RunCommandWithFds(context.Background(), &stdin, nil, "lxd", "init", "--preseed")
+	if currentCluster.Enabled {
+		if cfg.Idempotent && currentCluster.ServerName == s.name {
+			return s.reconcileBootstrapConfig(client, cfg)
+		}
+
+		return fmt.Errorf("This LXD server is already clustered")
+	}
+
+	var createdPools, createdNetworks, createdProfiles []string
+	rollback := func() {
+		// Cleanup always runs to completion, even if ctx is why we're rolling
+		// back, so it deliberately uses the unscoped client rather than client.
+		for _, name := range createdProfiles {
+			_ = s.client.DeleteProfile(name)
+		}
+
+		for _, name := range createdNetworks {
+			_ = s.client.DeleteNetwork(name)
+		}
+
+		for _, name := range createdPools {
+			_ = s.client.DeleteStoragePool(name)
+		}
+	}
+
+	for _, pool := range cfg.StoragePools {
+		// Idempotent here covers retrying a previous run that crashed after
+		// creating this pool but before finishing: tolerate it existing
+		// already rather than failing outright.
+		if cfg.Idempotent {
+			existing, etag, err := client.GetStoragePool(pool.Name)
+			if err == nil {
+				if !configSubsetMatches(pool.Config, existing.Config) {
+					put := existing.StoragePoolPut
+					put.Config = mergeConfig(existing.Config, pool.Config)
+					err = client.UpdateStoragePool(pool.Name, put, etag)
+					if err != nil {
+						rollback()
+						return newBootstrapError("storage pool", pool.Name, err)
+					}
+				}
+
+				continue
+			}
+		}
+
+		err := client.CreateStoragePool(pool)
+		if err != nil {
+			bootstrapErr := newBootstrapError("storage pool", pool.Name, err)
+			if cfg.Idempotent && bootstrapErr.Kind == BootstrapErrorExists {
+				continue
+			}
+
+			rollback()
+			return bootstrapErr
+		}
+
+		createdPools = append(createdPools, pool.Name)
+	}
+
+	for _, network := range cfg.Networks {
+		if cfg.Idempotent {
+			existing, etag, err := client.GetNetwork(network.Name)
+			if err == nil {
+				if !configSubsetMatches(network.Config, existing.Config) {
+					put := existing.NetworkPut
+					put.Config = mergeConfig(existing.Config, network.Config)
+					err = client.UpdateNetwork(network.Name, put, etag)
+					if err != nil {
+						rollback()
+						return newBootstrapError("network", network.Name, err)
+					}
+				}
+
+				continue
+			}
+		}
+
+		err := client.CreateNetwork(network)
+		if err != nil {
+			bootstrapErr := newBootstrapError("network", network.Name, err)
+			if cfg.Idempotent && bootstrapErr.Kind == BootstrapErrorExists {
+				continue
+			}
+
+			rollback()
+			return bootstrapErr
+		}
+
+		createdNetworks = append(createdNetworks, network.Name)
+	}
+
+	for _, profile := range cfg.Profiles {
+		// The "default" profile always exists, so update it in place rather
+		// than trying (and failing) to create it again.
+		if profile.Name == "default" {
+			err := client.UpdateProfile(profile.Name, profile.ProfilePut, "")
+			if err != nil {
+				rollback()
+				return newBootstrapError("profile", profile.Name, err)
+			}
+
+			continue
+		}
+
+		if cfg.Idempotent {
+			existing, etag, err := client.GetProfile(profile.Name)
+			if err == nil {
+				if !configSubsetMatches(profile.Config, existing.Config) || !devicesSubsetMatch(profile.Devices, existing.Devices) {
+					put := existing.ProfilePut
+					put.Config = mergeConfig(existing.Config, profile.Config)
+					put.Devices = mergeDevices(existing.Devices, profile.Devices)
+					err = client.UpdateProfile(profile.Name, put, etag)
+					if err != nil {
+						rollback()
+						return newBootstrapError("profile", profile.Name, err)
+					}
+				}
+
+				continue
+			}
+		}
+
+		err := client.CreateProfile(profile)
+		if err != nil {
+			bootstrapErr := newBootstrapError("profile", profile.Name, err)
+			if cfg.Idempotent && bootstrapErr.Kind == BootstrapErrorExists {
+				continue
+			}
+
+			rollback()
+			return bootstrapErr
+		}
+
+		createdProfiles = append(createdProfiles, profile.Name)
+	}
+
+	addr := util.CanonicalNetworkAddress(s.address, s.port)
+
+	config := map[string]any{"core.https_address": addr}
+	for k, v := range cfg.ServerConfig {
+		config[k] = v
+	}
+
+	// Only set cluster.https_address when it diverges from the API address,
+	// so a server with a single NIC leaves it unset and LXD uses
+	// core.https_address for cluster traffic too.
+	if clusterAddr := s.clusterAddressOverride(); clusterAddr != "" && clusterAddr != addr {
+		config["cluster.https_address"] = clusterAddr
+	}
+
+	err = client.UpdateServer(api.ServerPut{Config: config}, "")
 	if err != nil {
-		return fmt.Errorf("Failed to initialize LXD: %w", err)
+		rollback()
+		return newBootstrapError("server config", "", err)
 	}
 
-	currentCluster, etag, err := s.client.GetCluster()
+	currentCluster, etag, err := client.GetCluster()
 	if err != nil {
+		rollback()
 		return fmt.Errorf("Failed to retrieve current cluster config: %w", err)
 	}
 
 	if currentCluster.Enabled {
+		rollback()
 		return fmt.Errorf("This LXD server is already clustered")
 	}
 
-	op, err := s.client.UpdateCluster(api.ClusterPut{Cluster: api.Cluster{ServerName: s.name, Enabled: true}}, etag)
+	op, err := client.UpdateCluster(api.ClusterPut{Cluster: api.Cluster{ServerName: s.name, Enabled: true}}, etag)
 	if err != nil {
+		rollback()
 		return fmt.Errorf("Failed to enable clustering on local LXD: %w", err)
 	}
 
-	err = op.Wait()
+	err = op.WaitContext(ctx)
 	if err != nil {
+		rollback()
 		return fmt.Errorf("Failed to configure cluster :%w", err)
 	}
 
 	return nil
 }
 
+// reconcileBootstrapConfig applies cfg's storage pools, networks and
+// profiles to a node that is already clustered as s.name, updating whatever
+// has drifted from the desired config. It never creates new resources:
+// doing so on a clustered node requires a cluster-aware, per-member
+// (--target) create that Bootstrap doesn't implement, so a resource that
+// doesn't exist yet is reported as an error instead of attempted.
+//
+// Unlike the create path above, this doesn't special-case the "default"
+// profile: it always exists on a real LXD server, so GetProfile("default")
+// succeeds and the profile is updated like any other existing one. A
+// missing default profile is only reachable in a test double that doesn't
+// register one.
+func (s LXDService) reconcileBootstrapConfig(client lxd.InstanceServer, cfg BootstrapConfig) error {
+	for _, pool := range cfg.StoragePools {
+		existing, etag, err := client.GetStoragePool(pool.Name)
+		if err != nil {
+			return newBootstrapError("storage pool", pool.Name, fmt.Errorf("does not exist and cannot be created on an already-clustered node: %w", err))
+		}
+
+		if configSubsetMatches(pool.Config, existing.Config) {
+			continue
+		}
+
+		put := existing.StoragePoolPut
+		put.Config = mergeConfig(existing.Config, pool.Config)
+		err = client.UpdateStoragePool(pool.Name, put, etag)
+		if err != nil {
+			return newBootstrapError("storage pool", pool.Name, err)
+		}
+	}
+
+	for _, network := range cfg.Networks {
+		existing, etag, err := client.GetNetwork(network.Name)
+		if err != nil {
+			return newBootstrapError("network", network.Name, fmt.Errorf("does not exist and cannot be created on an already-clustered node: %w", err))
+		}
+
+		if configSubsetMatches(network.Config, existing.Config) {
+			continue
+		}
+
+		put := existing.NetworkPut
+		put.Config = mergeConfig(existing.Config, network.Config)
+		err = client.UpdateNetwork(network.Name, put, etag)
+		if err != nil {
+			return newBootstrapError("network", network.Name, err)
+		}
+	}
+
+	for _, profile := range cfg.Profiles {
+		existing, etag, err := client.GetProfile(profile.Name)
+		if err != nil {
+			return newBootstrapError("profile", profile.Name, fmt.Errorf("does not exist and cannot be created on an already-clustered node: %w", err))
+		}
+
+		if configSubsetMatches(profile.Config, existing.Config) && devicesSubsetMatch(profile.Devices, existing.Devices) {
+			continue
+		}
+
+		put := existing.ProfilePut
+		put.Config = mergeConfig(existing.Config, profile.Config)
+		put.Devices = mergeDevices(existing.Devices, profile.Devices)
+		err = client.UpdateProfile(profile.Name, put, etag)
+		if err != nil {
+			return newBootstrapError("profile", profile.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Restart requests that the LXD daemon shut down, then waits for it to come
+// back up and report itself as ready. This is used to make LXD re-read its
+// snap-provided state (e.g. storage/network drivers registered by sibling
+// services) before Bootstrap runs.
+//
+// The given context bounds the whole call (shutdown confirmation and
+// readiness together), same as every other LXDService operation, and
+// timeoutSeconds is its ceiling rather than a per-stage budget: waiting for
+// shutdown and waiting for readiness share the same deadline, so Restart
+// can't run up to 2x timeoutSeconds.
+func (s LXDService) Restart(ctx context.Context, timeoutSeconds int) error {
+	ctx, cancel := context.WithTimeout(s.useContext(ctx), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	_, _, err := s.clientContext(ctx).RawQuery("PUT", "/internal/shutdown", nil, "")
+	if err != nil {
+		return fmt.Errorf("Failed to shutdown LXD: %w", err)
+	}
+
+	// Shutdown is asynchronous, so wait for the daemon to actually go away
+	// before polling for readiness again. Otherwise the first readiness tick
+	// can still observe the pre-restart daemon and return too early.
+	err = s.waitStopped(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to wait for LXD to stop: %w", err)
+	}
+
+	err = s.WaitReady(ctx, timeoutSeconds)
+	if err != nil {
+		return fmt.Errorf("Failed to wait for LXD to restart: %w", err)
+	}
+
+	return nil
+}
+
+// waitStopped polls the LXD daemon until it stops responding, or returns an
+// error if ctx is done first.
+func (s LXDService) waitStopped(ctx context.Context) error {
+	client := s.clientContext(ctx)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("LXD did not shut down before the context expired: %w", ctx.Err())
+		case <-tick.C:
+			_, _, err := client.RawQuery("GET", "/internal/ready", nil, "")
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// WaitReady polls the LXD daemon until it reports itself as ready, or
+// returns an error if timeoutSeconds elapses (or ctx is done) first. This can
+// be called independently of Restart, e.g. right after Join hands off to a
+// freshly clustered daemon.
+func (s LXDService) WaitReady(ctx context.Context, timeoutSeconds int) error {
+	ctx, cancel := context.WithTimeout(s.useContext(ctx), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	client := s.clientContext(ctx)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("LXD did not become ready within %ds: %w", timeoutSeconds, ctx.Err())
+		case <-tick.C:
+			_, _, err := client.RawQuery("GET", "/internal/ready", nil, "")
+			if err == nil {
+				return nil
+			}
+		}
+	}
+}
+
 // Join joins a cluster with the given token.
-func (s LXDService) Join(token string) error {
+func (s LXDService) Join(ctx context.Context, token string) error {
+	ctx = s.useContext(ctx)
+	client := s.clientContext(ctx)
+
 	config, err := s.configFromToken(token)
 	if err != nil {
 		return err
@@ -112,12 +640,30 @@ func (s LXDService) Join(token string) error {
 		return fmt.Errorf("Failed to setup trust relationship with cluster: %w", err)
 	}
 
-	op, err := s.client.UpdateCluster(*config, "")
+	// Honor a dedicated cluster address for this member, if one is locally
+	// configured. Unlike StoragePools/Networks, config.MemberConfig doesn't
+	// carry this: it's per-member join input for the entities in the token
+	// (entity "storage-pool"/"network", e.g. a pool's "source"), not server
+	// config, so it has nothing to say about cluster.https_address.
+	//
+	// NOTE: this is a deliberate departure from a literal read of the
+	// "honor an override in the join token config" request this member was
+	// implemented for. There is no such override to read from the token;
+	// the override this method honors is s.clusterAddress, configured
+	// locally on this member the same way it is for Bootstrap.
+	if addr := s.clusterAddressOverride(); addr != "" {
+		err = client.UpdateServer(api.ServerPut{Config: map[string]any{"cluster.https_address": addr}}, "")
+		if err != nil {
+			return fmt.Errorf("Failed to set cluster address before joining: %w", err)
+		}
+	}
+
+	op, err := client.UpdateCluster(*config, "")
 	if err != nil {
 		return fmt.Errorf("Failed to join cluster: %w", err)
 	}
 
-	err = op.Wait()
+	err = op.WaitContext(ctx)
 	if err != nil {
 		return fmt.Errorf("Failed to join cluster: %w", err)
 	}
@@ -126,8 +672,8 @@ func (s LXDService) Join(token string) error {
 }
 
 // IssueToken issues a token for the given peer.
-func (s LXDService) IssueToken(peer string) (string, error) {
-	op, err := s.client.CreateClusterMember(api.ClusterMembersPost{ServerName: peer})
+func (s LXDService) IssueToken(ctx context.Context, peer string) (string, error) {
+	op, err := s.clientContext(ctx).CreateClusterMember(api.ClusterMembersPost{ServerName: peer})
 	if err != nil {
 		return "", err
 	}
@@ -159,4 +705,4 @@ func (s LXDService) Address() string {
 // Port returns the port of this Service instance.
 func (s LXDService) Port() int {
 	return s.port
-}
\ No newline at end of file
+}
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	lxd "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeLXDServer embeds lxd.InstanceServer so it satisfies the interface
+// without implementing every method, and overrides only the handful that
+// Bootstrap's reconcile path actually calls.
+type fakeLXDServer struct {
+	lxd.InstanceServer
+
+	cluster api.Cluster
+
+	pools    map[string]api.StoragePool
+	networks map[string]api.Network
+	profiles map[string]api.Profile
+
+	updatedPool    *api.StoragePoolPut
+	updatedNetwork *api.NetworkPut
+	updatedProfile *api.ProfilePut
+}
+
+func (f *fakeLXDServer) WithContext(ctx context.Context) lxd.InstanceServer {
+	return f
+}
+
+func (f *fakeLXDServer) GetCluster() (*api.Cluster, string, error) {
+	return &f.cluster, "cluster-etag", nil
+}
+
+func (f *fakeLXDServer) GetStoragePool(name string) (*api.StoragePool, string, error) {
+	pool, ok := f.pools[name]
+	if !ok {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Storage pool not found")
+	}
+
+	return &pool, "pool-etag", nil
+}
+
+func (f *fakeLXDServer) UpdateStoragePool(name string, put api.StoragePoolPut, ETag string) error {
+	f.updatedPool = &put
+	return nil
+}
+
+func (f *fakeLXDServer) GetNetwork(name string) (*api.Network, string, error) {
+	network, ok := f.networks[name]
+	if !ok {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Network not found")
+	}
+
+	return &network, "network-etag", nil
+}
+
+func (f *fakeLXDServer) UpdateNetwork(name string, put api.NetworkPut, ETag string) error {
+	f.updatedNetwork = &put
+	return nil
+}
+
+func (f *fakeLXDServer) GetProfile(name string) (*api.Profile, string, error) {
+	profile, ok := f.profiles[name]
+	if !ok {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Profile not found")
+	}
+
+	return &profile, "profile-etag", nil
+}
+
+func (f *fakeLXDServer) UpdateProfile(name string, put api.ProfilePut, ETag string) error {
+	f.updatedProfile = &put
+	return nil
+}
+
+var _ lxd.InstanceServer = &fakeLXDServer{}
+
+// preseedRoundTrip marshals cfg's pools/networks/profiles into the shape
+// `lxd init --preseed` consumes, then parses that YAML back the same way
+// `lxd init --dump` output would be, so tests can assert on what actually
+// survives the round-trip rather than on the Go struct directly.
+func preseedRoundTrip(t *testing.T, cfg BootstrapConfig) api.InitLocalPreseed {
+	t.Helper()
+
+	preseed := api.InitLocalPreseed{
+		StoragePools: cfg.StoragePools,
+		Networks:     cfg.Networks,
+		Profiles:     cfg.Profiles,
+	}
+
+	data, err := yaml.Marshal(preseed)
+	if err != nil {
+		t.Fatalf("Failed to marshal preseed: %v", err)
+	}
+
+	var parsed api.InitLocalPreseed
+	err = yaml.Unmarshal(data, &parsed)
+	if err != nil {
+		t.Fatalf("Failed to parse preseed: %v", err)
+	}
+
+	return parsed
+}
+
+func TestDefaultBootstrapConfigPreseedRoundTrip(t *testing.T) {
+	parsed := preseedRoundTrip(t, DefaultBootstrapConfig())
+
+	if len(parsed.StoragePools) != 1 || parsed.StoragePools[0].Name != "local" || parsed.StoragePools[0].Driver != "dir" {
+		t.Fatalf("unexpected storage pools after round-trip: %+v", parsed.StoragePools)
+	}
+
+	if len(parsed.Profiles) != 1 || parsed.Profiles[0].Name != "default" {
+		t.Fatalf("unexpected profiles after round-trip: %+v", parsed.Profiles)
+	}
+
+	want := map[string]string{"path": "/", "pool": "local", "type": "disk"}
+	if !reflect.DeepEqual(parsed.Profiles[0].Devices["root"], want) {
+		t.Fatalf("unexpected root disk device after round-trip: got %+v, want %+v", parsed.Profiles[0].Devices["root"], want)
+	}
+}
+
+func TestZFSLoopBootstrapConfigPreseedRoundTrip(t *testing.T) {
+	parsed := preseedRoundTrip(t, ZFSLoopBootstrapConfig(10))
+
+	if len(parsed.StoragePools) != 1 || parsed.StoragePools[0].Driver != "zfs" {
+		t.Fatalf("unexpected storage pools after round-trip: %+v", parsed.StoragePools)
+	}
+
+	if parsed.StoragePools[0].Config["size"] != "10GiB" {
+		t.Fatalf("unexpected zfs pool size after round-trip: %+v", parsed.StoragePools[0].Config)
+	}
+}
+
+func TestCephRBDBootstrapConfigPreseedRoundTrip(t *testing.T) {
+	parsed := preseedRoundTrip(t, CephRBDBootstrapConfig("my-cluster"))
+
+	if len(parsed.StoragePools) != 1 || parsed.StoragePools[0].Name != "remote" || parsed.StoragePools[0].Driver != "ceph" {
+		t.Fatalf("unexpected storage pools after round-trip: %+v", parsed.StoragePools)
+	}
+
+	// The default profile's root disk must point at the pool this config
+	// actually creates, or Bootstrap fails validating against a pool that
+	// was never created.
+	pool := parsed.Profiles[0].Devices["root"]["pool"]
+	if pool != parsed.StoragePools[0].Name {
+		t.Fatalf("default profile root disk pool %q does not match created pool %q", pool, parsed.StoragePools[0].Name)
+	}
+}
+
+func TestOVNUplinkBootstrapConfigPreseedRoundTrip(t *testing.T) {
+	parsed := preseedRoundTrip(t, OVNUplinkBootstrapConfig("eth1"))
+
+	if len(parsed.Networks) != 1 || parsed.Networks[0].Name != "UPLINK" || parsed.Networks[0].Type != "physical" {
+		t.Fatalf("unexpected networks after round-trip: %+v", parsed.Networks)
+	}
+
+	if parsed.Networks[0].Config["parent"] != "eth1" {
+		t.Fatalf("unexpected uplink parent after round-trip: %+v", parsed.Networks[0].Config)
+	}
+}
+
+// defaultProfileRootDisk is DefaultBootstrapConfig's "default" profile
+// devices, for fakes that need to report the profile as already existing
+// with no drift.
+var defaultProfileRootDisk = map[string]map[string]string{"root": {"path": "/", "pool": "local", "type": "disk"}}
+
+func TestBootstrapIdempotentReconcileNoDriftMatch(t *testing.T) {
+	fake := &fakeLXDServer{
+		cluster: api.Cluster{ServerName: "n1", Enabled: true},
+		pools: map[string]api.StoragePool{
+			// LXD fills in "source" on a dir pool even though it was never
+			// part of the desired config; a sparse desired Config must still
+			// be considered a match.
+			"local": {StoragePoolPut: api.StoragePoolPut{Config: map[string]string{"source": "/var/snap/lxd/common/lxd/storage-pools/local"}}, Name: "local", Driver: "dir"},
+		},
+		profiles: map[string]api.Profile{
+			// reconcileBootstrapConfig calls GetProfile("default") same as
+			// the pools above, since DefaultBootstrapConfig always ships one.
+			"default": {ProfilePut: api.ProfilePut{Devices: defaultProfileRootDisk}, Name: "default"},
+		},
+	}
+
+	s := LXDService{client: fake, name: "n1"}
+	err := s.Bootstrap(nil, DefaultBootstrapConfig().withIdempotent())
+	if err != nil {
+		t.Fatalf("Bootstrap returned error on drift-free reconcile: %v", err)
+	}
+
+	if fake.updatedPool != nil {
+		t.Fatalf("Bootstrap issued an update despite no drift: %+v", fake.updatedPool)
+	}
+
+	if fake.updatedProfile != nil {
+		t.Fatalf("Bootstrap issued a profile update despite no drift: %+v", fake.updatedProfile)
+	}
+}
+
+func TestBootstrapIdempotentReconcileAppliesDrift(t *testing.T) {
+	fake := &fakeLXDServer{
+		cluster: api.Cluster{ServerName: "n1", Enabled: true},
+		pools: map[string]api.StoragePool{
+			"local": {StoragePoolPut: api.StoragePoolPut{Config: map[string]string{"source": "/existing/source", "size": "5GiB"}}, Name: "local", Driver: "dir"},
+		},
+		profiles: map[string]api.Profile{
+			// No root disk device yet, so reconcile must add one.
+			"default": {ProfilePut: api.ProfilePut{Devices: map[string]map[string]string{}}, Name: "default"},
+		},
+	}
+
+	cfg := DefaultBootstrapConfig().withIdempotent()
+	cfg.StoragePools[0].Config = map[string]string{"size": "10GiB"}
+
+	s := LXDService{client: fake, name: "n1"}
+	err := s.Bootstrap(nil, cfg)
+	if err != nil {
+		t.Fatalf("Bootstrap returned error applying drift: %v", err)
+	}
+
+	if fake.updatedPool == nil {
+		t.Fatalf("Bootstrap did not update the drifted pool")
+	}
+
+	// The computed "source" key the caller never mentioned must survive
+	// the update rather than being cleared.
+	if fake.updatedPool.Config["source"] != "/existing/source" {
+		t.Fatalf("update cleared computed source key: %+v", fake.updatedPool.Config)
+	}
+
+	if fake.updatedPool.Config["size"] != "10GiB" {
+		t.Fatalf("update did not apply the desired size: %+v", fake.updatedPool.Config)
+	}
+
+	if fake.updatedProfile == nil {
+		t.Fatalf("Bootstrap did not update the drifted default profile")
+	}
+
+	if !reflect.DeepEqual(fake.updatedProfile.Devices["root"], defaultProfileRootDisk["root"]) {
+		t.Fatalf("update did not apply the desired root disk device: %+v", fake.updatedProfile.Devices["root"])
+	}
+}
+
+func TestBootstrapIdempotentReconcileMissingResourceErrors(t *testing.T) {
+	fake := &fakeLXDServer{
+		cluster: api.Cluster{ServerName: "n1", Enabled: true},
+		pools:   map[string]api.StoragePool{},
+	}
+
+	s := LXDService{client: fake, name: "n1"}
+	err := s.Bootstrap(nil, DefaultBootstrapConfig().withIdempotent())
+	if err == nil {
+		t.Fatalf("Bootstrap did not error for a pool missing on an already-clustered node")
+	}
+
+	var bootstrapErr *BootstrapError
+	if !errors.As(err, &bootstrapErr) {
+		t.Fatalf("expected a *BootstrapError, got %T: %v", err, err)
+	}
+}
+
+// withIdempotent returns a copy of cfg with Idempotent set, so tests can
+// derive a case from the shared constructor helpers without mutating them.
+func (cfg BootstrapConfig) withIdempotent() BootstrapConfig {
+	cfg.Idempotent = true
+	return cfg
+}
+
+func TestLXDServiceClusterAddressOverride(t *testing.T) {
+	s := LXDService{port: LXDPort}
+	if got := s.clusterAddressOverride(); got != "" {
+		t.Fatalf("expected no override with clusterAddress unset, got %q", got)
+	}
+
+	s.clusterAddress = "10.0.0.1"
+	got := s.clusterAddressOverride()
+	want := fmt.Sprintf("10.0.0.1:%d", LXDPort)
+	if got != want {
+		t.Fatalf("unexpected cluster address override: got %q, want %q", got, want)
+	}
+}